@@ -25,11 +25,20 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
+// DefaultProfile is the name given to the profile used when the configuration file doesn't specify
+// one explicitly, and the name under which a legacy single-profile configuration file is migrated.
+const DefaultProfile = "default"
+
+// profileEnvVar is the name of the environment variable that selects the profile to use, overriding
+// the current profile stored in the configuration file.
+const profileEnvVar = "UHC_PROFILE"
+
 // Config is the type used to store the configuration of the client.
 type Config struct {
 	AccessToken  string   `json:"access_token,omitempty"`
@@ -45,85 +54,335 @@ type Config struct {
 	User         string   `json:"user,omitempty"`
 }
 
-// Load loads the configuration from the configuration file. If the configuration file doesn't exist
-// it will return an empty configuration object.
+// File is the type used to store the contents of the configuration file. It holds a set of named
+// profiles, each with its own independent configuration, plus the name of the profile that should be
+// used when none is selected explicitly.
+type File struct {
+	CurrentProfile string             `json:"current_profile,omitempty"`
+	Profiles       map[string]*Config `json:"profiles,omitempty"`
+}
+
+// Load loads the configuration of the current profile from the configuration file. If the
+// configuration file doesn't exist it will return an empty configuration object. The current profile
+// is selected using the UHC_PROFILE environment variable, falling back to the profile stored in the
+// configuration file, and finally to DefaultProfile.
 func Load() (cfg *Config, err error) {
+	return LoadProfile("")
+}
+
+// Save saves the given configuration as the current profile in the configuration file.
+func Save(cfg *Config) error {
+	return SaveProfile("", cfg)
+}
+
+// Remove removes the configuration file.
+func Remove() error {
 	file, err := Location()
 	if err != nil {
-		return
+		return err
 	}
 	_, err = os.Stat(file)
 	if os.IsNotExist(err) {
-		cfg = nil
-		err = nil
+		return nil
+	}
+	err = os.Remove(file)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// overrideLocation is the path set via SetLocation, typically from the `--config` global flag. It
+// takes precedence over everything else.
+var overrideLocation string
+
+// SetLocation overrides the location of the configuration file, for example from the `--config` global
+// flag, or from tests that want to point at a throwaway file. Pass the empty string to go back to the
+// normal resolution order.
+func SetLocation(path string) {
+	overrideLocation = path
+}
+
+// Location returns the location of the configuration file. The path is resolved, in order of
+// precedence, from: the path set via SetLocation (the `--config` global flag), the UHC_CONFIG
+// environment variable, $XDG_CONFIG_HOME/uhc/config.json (falling back to $HOME/.config/uhc/config.json
+// when XDG_CONFIG_HOME isn't set), and finally the legacy $HOME/.uhc.json, if that's the only one of
+// the two that exists. Location is a pure resolver: it never touches the file system beyond checking
+// which of the candidate paths exists. The legacy file is migrated to the new XDG location, with a one
+// time copy, the first time writeLocation is used to save the file; see saveFile for the removal of the
+// legacy file (and the clear text secrets it may still hold) once that copy has landed.
+func Location() (path string, err error) {
+	if overrideLocation != "" {
+		path = overrideLocation
+		return
+	}
+	if env := os.Getenv("UHC_CONFIG"); env != "" {
+		path = env
 		return
 	}
+	path, err = xdgConfigLocation()
 	if err != nil {
-		err = fmt.Errorf("can't check if config file '%s' exists: %v", file, err)
 		return
 	}
-	// #nosec G304
-	data, err := ioutil.ReadFile(file)
+	_, err = os.Stat(path)
+	if err == nil {
+		return
+	}
+	if !os.IsNotExist(err) {
+		err = fmt.Errorf("can't check if config file '%s' exists: %v", path, err)
+		return
+	}
+	err = nil
+	legacy, legacyErr := legacyConfigLocation()
+	if legacyErr != nil {
+		return
+	}
+	if _, statErr := os.Stat(legacy); statErr == nil {
+		path = legacy
+	}
+	return
+}
+
+// writeLocation returns the path that should be written to when saving the configuration file. It
+// matches Location, except that when Location would resolve to the legacy file (because the new XDG
+// location doesn't exist yet) it returns the new XDG location instead, creating its parent directory.
+// This is what performs the one time migration away from the legacy file: the first save of a legacy
+// configuration lands at the new location, carrying forward whatever was just loaded from the legacy
+// file, and every subsequent load or save then resolves to the new location. saveFile removes the
+// legacy file once that first save at the new location succeeds, since it may still hold sensitive
+// fields in clear text from before SecretStore existed.
+func writeLocation() (path string, err error) {
+	path, err = Location()
 	if err != nil {
-		err = fmt.Errorf("can't read config file '%s': %v", file, err)
 		return
 	}
-	cfg = new(Config)
-	err = json.Unmarshal(data, cfg)
+	legacy, legacyErr := legacyConfigLocation()
+	if legacyErr == nil && path == legacy {
+		path, err = xdgConfigLocation()
+		if err != nil {
+			return
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
 	if err != nil {
-		err = fmt.Errorf("can't parse config file '%s': %v", file, err)
+		err = fmt.Errorf("can't create directory for config file '%s': %v", path, err)
+	}
+	return
+}
+
+// xdgConfigLocation returns the location of the configuration file following the XDG base directory
+// specification.
+func xdgConfigLocation() (path string, err error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		path = filepath.Join(dir, "uhc", "config.json")
 		return
 	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		err = fmt.Errorf("can't find home directory, HOME environment variable is empty")
+		return
+	}
+	path = filepath.Join(home, ".config", "uhc", "config.json")
 	return
 }
 
-// Save saves the given configuration to the configuration file.
-func Save(cfg *Config) error {
-	file, err := Location()
-	if err != nil {
-		return err
+// legacyConfigLocation returns the location of the configuration file used before XDG support was
+// added.
+func legacyConfigLocation() (path string, err error) {
+	home := os.Getenv("HOME")
+	if home == "" {
+		err = fmt.Errorf("can't find home directory, HOME environment variable is empty")
+		return
 	}
-	data, err := json.MarshalIndent(cfg, "", "  ")
+	path = filepath.Join(home, ".uhc.json")
+	return
+}
+
+// LoadProfile loads the configuration stored under the given profile name. If name is empty the
+// profile is resolved using the UHC_PROFILE environment variable, the current profile stored in the
+// configuration file, or DefaultProfile, in that order. If the profile doesn't exist yet it returns an
+// empty configuration object.
+func LoadProfile(name string) (cfg *Config, err error) {
+	file, err := loadFile()
 	if err != nil {
-		return fmt.Errorf("can't marshal config: %v", err)
+		return
+	}
+	name = resolveProfile(file, name)
+	cfg, ok := file.Profiles[name]
+	if !ok {
+		cfg = new(Config)
 	}
-	err = ioutil.WriteFile(file, data, 0600)
+	err = injectSecrets(newSecretStore(), name, cfg)
 	if err != nil {
-		return fmt.Errorf("can't write file '%s': %v", file, err)
+		return
 	}
-	return nil
+	return
 }
 
-// Remove removes the configuration file.
-func Remove() error {
-	file, err := Location()
+// SaveProfile saves the given configuration under the given profile name. If name is empty the profile
+// is resolved the same way as in LoadProfile. The sensitive fields of cfg (ClientSecret, Password,
+// AccessToken and RefreshToken) are written to the configured SecretStore instead of the plain text
+// configuration file.
+func SaveProfile(name string, cfg *Config) error {
+	file, err := loadFile()
 	if err != nil {
 		return err
 	}
-	_, err = os.Stat(file)
-	if os.IsNotExist(err) {
-		return nil
+	name = resolveProfile(file, name)
+	disk, err := extractSecrets(newSecretStore(), name, cfg)
+	if err != nil {
+		return err
 	}
-	err = os.Remove(file)
+	if file.Profiles == nil {
+		file.Profiles = map[string]*Config{}
+	}
+	file.Profiles[name] = disk
+	return saveFile(file)
+}
+
+// ListProfiles returns the names of the profiles currently stored in the configuration file, sorted
+// alphabetically.
+func ListProfiles() (names []string, err error) {
+	file, err := loadFile()
+	if err != nil {
+		return
+	}
+	names = make([]string, 0, len(file.Profiles))
+	for name := range file.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// UseProfile sets the given profile as the current profile, so that it is used by default when none is
+// selected explicitly via the UHC_PROFILE environment variable.
+func UseProfile(name string) error {
+	file, err := loadFile()
 	if err != nil {
 		return err
 	}
-	return nil
+	if _, ok := file.Profiles[name]; !ok {
+		return fmt.Errorf("profile '%s' doesn't exist", name)
+	}
+	file.CurrentProfile = name
+	return saveFile(file)
 }
 
-// Location returns the location of the configuration file.
-func Location() (path string, err error) {
-	home := os.Getenv("HOME")
-	if home == "" {
-		err = fmt.Errorf("can't find home directory, HOME environment variable is empty")
+// resolveProfile resolves the profile name to use, following the explicitly given name, the
+// UHC_PROFILE environment variable, the current profile stored in the file, and finally
+// DefaultProfile, in that order of precedence. An explicitly given name always wins, so that callers
+// that target a specific profile (like a TokenSource bound to it) aren't redirected by an ambient
+// UHC_PROFILE set in the environment.
+func resolveProfile(file *File, name string) string {
+	if name != "" {
+		return name
+	}
+	if env := os.Getenv(profileEnvVar); env != "" {
+		return env
+	}
+	if file.CurrentProfile != "" {
+		return file.CurrentProfile
+	}
+	return DefaultProfile
+}
+
+// loadFile loads the contents of the configuration file. If the file doesn't exist it returns an empty
+// File ready to be populated. If the file is in the legacy single-profile format it is transparently
+// migrated in memory into a File containing a single profile named DefaultProfile; the migration is
+// only persisted to disk the next time the file is saved.
+func loadFile() (file *File, err error) {
+	path, err := Location()
+	if err != nil {
 		return
 	}
-	path = filepath.Join(home, ".uhc.json")
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		file = &File{
+			Profiles: map[string]*Config{},
+		}
+		err = nil
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("can't check if config file '%s' exists: %v", path, err)
+		return
+	}
+	// #nosec G304
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("can't read config file '%s': %v", path, err)
+		return
+	}
+	var generic map[string]json.RawMessage
+	err = json.Unmarshal(data, &generic)
+	if err != nil {
+		err = fmt.Errorf("can't parse config file '%s': %v", path, err)
+		return
+	}
+	if _, ok := generic["profiles"]; ok {
+		file = new(File)
+		err = json.Unmarshal(data, file)
+		if err != nil {
+			err = fmt.Errorf("can't parse config file '%s': %v", path, err)
+			return
+		}
+		if file.Profiles == nil {
+			file.Profiles = map[string]*Config{}
+		}
+		return
+	}
+	legacy := new(Config)
+	err = json.Unmarshal(data, legacy)
+	if err != nil {
+		err = fmt.Errorf("can't parse config file '%s': %v", path, err)
+		return
+	}
+	file = &File{
+		CurrentProfile: DefaultProfile,
+		Profiles: map[string]*Config{
+			DefaultProfile: legacy,
+		},
+	}
 	return
 }
 
+// saveFile writes the given File to the configuration file. If this save migrates away from the
+// legacy configuration file, the legacy file is removed once the new one has been written
+// successfully, since it may still hold the sensitive fields in clear text from before they were split
+// off into the SecretStore.
+func saveFile(file *File) error {
+	readPath, err := Location()
+	if err != nil {
+		return err
+	}
+	path, err := writeLocation()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't marshal config: %v", err)
+	}
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("can't write file '%s': %v", path, err)
+	}
+	if readPath != path {
+		err = os.Remove(readPath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("can't remove legacy config file '%s': %v", readPath, err)
+		}
+	}
+	return nil
+}
+
 // Armed checks if the configuration contains either credentials or tokens that haven't expired, so
-// that it can be used to perform authenticated requests.
+// that it can be used to perform authenticated requests. Token staleness is judged by the same
+// DefaultTokenThreshold that TokenSource uses to decide when to refresh, instead of a bespoke
+// heuristic, so Armed and TokenSource never disagree about whether a token is still good. Unlike
+// TokenSource's internal staleness check, a malformed token is reported as an error rather than simply
+// treated as not armed.
 func Armed(cfg *Config) (armed bool, err error) {
 	if cfg.User != "" && cfg.Password != "" {
 		armed = true
@@ -133,15 +392,14 @@ func Armed(cfg *Config) (armed bool, err error) {
 		armed = true
 		return
 	}
-	now := time.Now()
 	if cfg.AccessToken != "" {
 		var expires bool
 		var left time.Duration
-		expires, left, err = tokenExpiry(cfg.AccessToken, now)
+		expires, left, err = tokenExpiry(cfg.AccessToken, time.Now())
 		if err != nil {
 			return
 		}
-		if !expires || left > 5*time.Second {
+		if !expires || left > DefaultTokenThreshold {
 			armed = true
 			return
 		}
@@ -149,11 +407,11 @@ func Armed(cfg *Config) (armed bool, err error) {
 	if cfg.RefreshToken != "" {
 		var expires bool
 		var left time.Duration
-		expires, left, err = tokenExpiry(cfg.RefreshToken, now)
+		expires, left, err = tokenExpiry(cfg.RefreshToken, time.Now())
 		if err != nil {
 			return
 		}
-		if !expires || left > 10*time.Second {
+		if !expires || left > DefaultTokenThreshold {
 			armed = true
 			return
 		}
@@ -0,0 +1,299 @@
+/*
+Copyright (c) 2018 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file contains the implementation of the OAuth 2.0 device authorization grant, used to log in
+// interactively without ever asking the user for their password.
+
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// deviceGrantType is the value of the `grant_type` parameter used to redeem a device code for a token.
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// DeviceLoginOptions contains the options used by DeviceLogin to drive the device authorization grant.
+type DeviceLoginOptions struct {
+	// TokenURL is the URL of the OAuth 2.0 token endpoint. Required.
+	TokenURL string
+
+	// DeviceAuthURL is the URL of the OAuth 2.0 device authorization endpoint. If empty it defaults to
+	// TokenURL with its last path segment replaced by `auth/device`.
+	DeviceAuthURL string
+
+	// ClientID is the OAuth 2.0 client identifier used for the login. Required.
+	ClientID string
+
+	// ClientSecret is the OAuth 2.0 client secret, for clients that require one. Optional.
+	ClientSecret string
+
+	// Scopes is the list of OAuth 2.0 scopes requested for the token. Optional.
+	Scopes []string
+
+	// Insecure disables verification of the TLS certificates of the SSO server. Optional.
+	Insecure bool
+
+	// Writer is where the user code and verification URL are printed. Defaults to os.Stdout.
+	Writer io.Writer
+}
+
+// deviceAuthorizationResponse is the body returned by the device authorization endpoint.
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+	Error                   string `json:"error"`
+	ErrorDescription        string `json:"error_description"`
+}
+
+// deviceTokenResponse is the body returned by the token endpoint while polling.
+type deviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+}
+
+// DeviceLogin performs the OAuth 2.0 device authorization grant: it requests a device and user code
+// from the SSO server, prints the user code and opens the verification URL in a browser on a best
+// effort basis, then polls the token endpoint until the user completes the login, the code expires, or
+// the context is canceled. On success it persists the resulting access and refresh tokens through Save
+// and clears any previously stored user name and password.
+func DeviceLogin(ctx context.Context, options DeviceLoginOptions) (cfg *Config, err error) {
+	writer := options.Writer
+	if writer == nil {
+		writer = os.Stdout
+	}
+	client := deviceHTTPClient(options.Insecure)
+
+	auth, err := requestDeviceAuthorization(ctx, client, options)
+	if err != nil {
+		err = fmt.Errorf("can't request device authorization: %v", err)
+		return
+	}
+
+	if auth.VerificationURIComplete != "" {
+		fmt.Fprintf(writer, "To complete the login, open the following URL in your browser and check that it shows the code '%s':\n\n  %s\n\n", auth.UserCode, auth.VerificationURIComplete)
+	} else {
+		fmt.Fprintf(writer, "To complete the login, open the following URL in your browser and enter the code '%s':\n\n  %s\n\n", auth.UserCode, auth.VerificationURI)
+	}
+	openBrowser(auth.VerificationURIComplete, auth.VerificationURI)
+
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	var deadline time.Time
+	if auth.ExpiresIn > 0 {
+		deadline = time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	}
+
+	var tokens *deviceTokenResponse
+	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			err = fmt.Errorf("device code expired before the login was completed")
+			return
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(interval):
+		}
+		tokens, err = pollDeviceToken(ctx, client, options, auth.DeviceCode)
+		if err != nil {
+			return
+		}
+		if tokens.Error == "" {
+			break
+		}
+		switch tokens.Error {
+		case "slow_down":
+			interval += 5 * time.Second
+		case "authorization_pending":
+			// Keep polling.
+		case "expired_token":
+			err = fmt.Errorf("device code expired before the login was completed")
+			return
+		case "access_denied":
+			err = fmt.Errorf("login was denied")
+			return
+		default:
+			err = fmt.Errorf("device login failed with error '%s'", tokens.Error)
+			return
+		}
+	}
+
+	cfg, err = Load()
+	if err != nil {
+		return
+	}
+	cfg.AccessToken = tokens.AccessToken
+	cfg.RefreshToken = tokens.RefreshToken
+	cfg.TokenURL = options.TokenURL
+	cfg.ClientID = options.ClientID
+	cfg.ClientSecret = options.ClientSecret
+	cfg.Scopes = options.Scopes
+	cfg.Insecure = options.Insecure
+	cfg.User = ""
+	cfg.Password = ""
+	err = Save(cfg)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func requestDeviceAuthorization(ctx context.Context, client *http.Client, options DeviceLoginOptions) (auth *deviceAuthorizationResponse, err error) {
+	endpoint := options.DeviceAuthURL
+	if endpoint == "" {
+		endpoint = deviceAuthURLFromTokenURL(options.TokenURL)
+	}
+	values := url.Values{}
+	values.Set("client_id", options.ClientID)
+	if len(options.Scopes) > 0 {
+		values.Set("scope", strings.Join(options.Scopes, " "))
+	}
+	body, status, err := doDeviceRequest(ctx, client, endpoint, values)
+	if err != nil {
+		return
+	}
+	auth = new(deviceAuthorizationResponse)
+	err = json.Unmarshal(body, auth)
+	if err != nil {
+		err = fmt.Errorf("can't parse device authorization response: %v", err)
+		return
+	}
+	if auth.Error != "" {
+		err = fmt.Errorf("device authorization request failed with error '%s'", auth.Error)
+		auth = nil
+		return
+	}
+	if status < 200 || status >= 300 || auth.DeviceCode == "" {
+		err = fmt.Errorf("device authorization request to '%s' failed with status %d", endpoint, status)
+		auth = nil
+		return
+	}
+	return
+}
+
+func pollDeviceToken(ctx context.Context, client *http.Client, options DeviceLoginOptions, deviceCode string) (tokens *deviceTokenResponse, err error) {
+	values := url.Values{}
+	values.Set("grant_type", deviceGrantType)
+	values.Set("device_code", deviceCode)
+	values.Set("client_id", options.ClientID)
+	if options.ClientSecret != "" {
+		values.Set("client_secret", options.ClientSecret)
+	}
+	body, _, err := doDeviceRequest(ctx, client, options.TokenURL, values)
+	if err != nil {
+		return
+	}
+	tokens = new(deviceTokenResponse)
+	err = json.Unmarshal(body, tokens)
+	if err != nil {
+		err = fmt.Errorf("can't parse token response: %v", err)
+		return
+	}
+	return
+}
+
+func doDeviceRequest(ctx context.Context, client *http.Client, endpoint string, values url.Values) (body []byte, status int, err error) {
+	request, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		err = fmt.Errorf("can't create request for '%s': %v", endpoint, err)
+		return
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		err = fmt.Errorf("can't send request to '%s': %v", endpoint, err)
+		return
+	}
+	defer response.Body.Close()
+	status = response.StatusCode
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		err = fmt.Errorf("can't read response from '%s': %v", endpoint, err)
+		return
+	}
+	return
+}
+
+// deviceAuthURLFromTokenURL derives the device authorization endpoint from the token endpoint by
+// replacing its last path segment with `auth/device`, as used by the SSO server.
+func deviceAuthURLFromTokenURL(tokenURL string) string {
+	index := strings.LastIndex(tokenURL, "/")
+	if index == -1 {
+		return tokenURL
+	}
+	return tokenURL[:index] + "/auth/device"
+}
+
+func deviceHTTPClient(insecure bool) *http.Client {
+	if !insecure {
+		return http.DefaultClient
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				// #nosec G402
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+}
+
+// openBrowser tries to open the given URL (preferring the complete verification URL, falling back to
+// the plain one) in the user's default browser. Failures are ignored, since the user can always open
+// the URL manually from the text already printed.
+func openBrowser(preferred, fallback string) {
+	target := preferred
+	if target == "" {
+		target = fallback
+	}
+	if target == "" {
+		return
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", target)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", target)
+	default:
+		cmd = exec.Command("xdg-open", target)
+	}
+	// Best effort: if there's no browser, or no display, just ignore the error.
+	_ = cmd.Start()
+}
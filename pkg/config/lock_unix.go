@@ -0,0 +1,53 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright (c) 2018 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLock is an inter-process, advisory exclusive lock backed by flock(2). It is used to prevent
+// concurrent `uhc` invocations from racing while refreshing and persisting tokens.
+type fileLock struct {
+	file *os.File
+}
+
+// newFileLock opens (creating it if necessary) the file at path and blocks until an exclusive lock on
+// it has been acquired.
+func newFileLock(path string) (lock *fileLock, err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		file.Close()
+		return
+	}
+	lock = &fileLock{file: file}
+	return
+}
+
+// Unlock releases the lock.
+func (l *fileLock) Unlock() error {
+	defer l.file.Close()
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,64 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright (c) 2018 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// fileLock is an inter-process, advisory exclusive lock backed by LockFileEx on an open file handle.
+// It is used to prevent concurrent `uhc` invocations from racing while refreshing and persisting
+// tokens. Unlike a sentinel file created and deleted by hand, the lock is released by the OS as soon as
+// the handle is closed, including when the holding process is killed or panics, so a crashed `uhc`
+// can never leave every future invocation spinning on an orphaned lock file.
+type fileLock struct {
+	file *os.File
+}
+
+// newFileLock opens (creating it if necessary) the file at path and blocks until an exclusive
+// LockFileEx lock on it has been acquired.
+func newFileLock(path string) (lock *fileLock, err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+	var overlapped windows.Overlapped
+	err = windows.LockFileEx(
+		windows.Handle(file.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK,
+		0, 1, 0,
+		&overlapped,
+	)
+	if err != nil {
+		file.Close()
+		return
+	}
+	lock = &fileLock{file: file}
+	return
+}
+
+// Unlock releases the lock.
+func (l *fileLock) Unlock() error {
+	defer l.file.Close()
+	var overlapped windows.Overlapped
+	return windows.UnlockFileEx(windows.Handle(l.file.Fd()), 0, 1, 0, &overlapped)
+}
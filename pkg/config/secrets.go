@@ -0,0 +1,307 @@
+/*
+Copyright (c) 2018 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file contains the types and functions used to keep the sensitive fields of the configuration
+// (passwords and tokens) out of the plain text configuration file.
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/zalando/go-keyring"
+)
+
+// secretStoreEnvVar is the name of the environment variable that selects the secret store backend,
+// overriding the default. Corresponds to the `--secret-store` global flag.
+const secretStoreEnvVar = "UHC_SECRET_STORE"
+
+// ErrSecretNotFound is returned by a SecretStore when the requested secret doesn't exist.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretStore is the interface implemented by the backends used to store the sensitive fields of the
+// configuration (passwords and tokens) separately from the plain text configuration file.
+type SecretStore interface {
+	// Get returns the secret stored under the given namespace and key. It returns ErrSecretNotFound
+	// if no such secret exists.
+	Get(namespace, key string) (string, error)
+
+	// Set stores the given secret under the given namespace and key, overwriting any previous value.
+	Set(namespace, key, value string) error
+
+	// Delete removes the secret stored under the given namespace and key. It is not an error to
+	// delete a secret that doesn't exist.
+	Delete(namespace, key string) error
+}
+
+// newSecretStore creates the SecretStore selected via the UHC_SECRET_STORE environment variable
+// ("keyring" or "file"). With neither set, the default tries the OS keyring first and falls back to
+// the file based store automatically whenever the keyring itself isn't usable (no libsecret/D-Bus
+// session, headless CI, ...), so secrets are kept out of plain text JSON wherever a keyring is
+// available, without existing keyring-less automations breaking.
+func newSecretStore() SecretStore {
+	switch os.Getenv(secretStoreEnvVar) {
+	case "keyring":
+		return new(KeyringSecretStore)
+	case "file":
+		return new(FileSecretStore)
+	default:
+		return &fallbackSecretStore{
+			primary:  new(KeyringSecretStore),
+			fallback: new(FileSecretStore),
+		}
+	}
+}
+
+// fallbackSecretStore tries primary first and transparently falls back to fallback whenever primary
+// itself can't service the request (for example because there's no keyring daemon running), as opposed
+// to when primary simply doesn't have the requested secret.
+type fallbackSecretStore struct {
+	primary  SecretStore
+	fallback SecretStore
+}
+
+// Get is part of the SecretStore interface.
+func (s *fallbackSecretStore) Get(namespace, key string) (value string, err error) {
+	value, err = s.primary.Get(namespace, key)
+	if err == nil || err == ErrSecretNotFound {
+		return
+	}
+	return s.fallback.Get(namespace, key)
+}
+
+// Set is part of the SecretStore interface.
+func (s *fallbackSecretStore) Set(namespace, key, value string) error {
+	err := s.primary.Set(namespace, key, value)
+	if err == nil {
+		return nil
+	}
+	return s.fallback.Set(namespace, key, value)
+}
+
+// Delete is part of the SecretStore interface.
+func (s *fallbackSecretStore) Delete(namespace, key string) error {
+	err := s.primary.Delete(namespace, key)
+	if err == nil {
+		return nil
+	}
+	return s.fallback.Delete(namespace, key)
+}
+
+// KeyringSecretStore stores secrets in the OS keyring: the macOS Keychain, the Windows Credential
+// Manager, or libsecret/kwallet on Linux.
+type KeyringSecretStore struct {
+}
+
+// Get is part of the SecretStore interface.
+func (s *KeyringSecretStore) Get(namespace, key string) (value string, err error) {
+	value, err = keyring.Get(keyringService(namespace), key)
+	if err == keyring.ErrNotFound {
+		err = ErrSecretNotFound
+	}
+	return
+}
+
+// Set is part of the SecretStore interface.
+func (s *KeyringSecretStore) Set(namespace, key, value string) error {
+	return keyring.Set(keyringService(namespace), key, value)
+}
+
+// Delete is part of the SecretStore interface.
+func (s *KeyringSecretStore) Delete(namespace, key string) error {
+	err := keyring.Delete(keyringService(namespace), key)
+	if err != nil && err != keyring.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// keyringService builds the keyring service name for the given namespace.
+func keyringService(namespace string) string {
+	return fmt.Sprintf("uhc:%s", namespace)
+}
+
+// FileSecretStore stores secrets in a plain text file on disk, separate from the main configuration
+// file. It exists as a fallback for headless environments, like CI, where no OS keyring is available;
+// `--secret-store=file` selects it explicitly.
+type FileSecretStore struct {
+}
+
+// fileSecretStoreData is the on disk representation used by FileSecretStore, a namespace to key to
+// value map.
+type fileSecretStoreData map[string]map[string]string
+
+// Get is part of the SecretStore interface.
+func (s *FileSecretStore) Get(namespace, key string) (value string, err error) {
+	data, err := loadSecretStoreFile()
+	if err != nil {
+		return
+	}
+	keys, ok := data[namespace]
+	if !ok {
+		err = ErrSecretNotFound
+		return
+	}
+	value, ok = keys[key]
+	if !ok {
+		err = ErrSecretNotFound
+		return
+	}
+	return
+}
+
+// Set is part of the SecretStore interface.
+func (s *FileSecretStore) Set(namespace, key, value string) error {
+	data, err := loadSecretStoreFile()
+	if err != nil {
+		return err
+	}
+	if data[namespace] == nil {
+		data[namespace] = map[string]string{}
+	}
+	data[namespace][key] = value
+	return saveSecretStoreFile(data)
+}
+
+// Delete is part of the SecretStore interface.
+func (s *FileSecretStore) Delete(namespace, key string) error {
+	data, err := loadSecretStoreFile()
+	if err != nil {
+		return err
+	}
+	if data[namespace] == nil {
+		return nil
+	}
+	delete(data[namespace], key)
+	return saveSecretStoreFile(data)
+}
+
+// secretStoreLocation returns the location of the file used by FileSecretStore. It sits next to the
+// path the configuration file is written to, so that secrets saved while migrating away from the
+// legacy configuration file are found again at the new location.
+func secretStoreLocation() (path string, err error) {
+	configPath, err := writeLocation()
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(configPath)
+	path = filepath.Join(dir, ".uhc_secrets.json")
+	return
+}
+
+func loadSecretStoreFile() (data fileSecretStoreData, err error) {
+	path, err := secretStoreLocation()
+	if err != nil {
+		return
+	}
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		data = fileSecretStoreData{}
+		err = nil
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("can't check if secrets file '%s' exists: %v", path, err)
+		return
+	}
+	// #nosec G304
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("can't read secrets file '%s': %v", path, err)
+		return
+	}
+	data = fileSecretStoreData{}
+	err = json.Unmarshal(raw, &data)
+	if err != nil {
+		err = fmt.Errorf("can't parse secrets file '%s': %v", path, err)
+		return
+	}
+	return
+}
+
+func saveSecretStoreFile(data fileSecretStoreData) error {
+	path, err := secretStoreLocation()
+	if err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't marshal secrets: %v", err)
+	}
+	err = ioutil.WriteFile(path, raw, 0600)
+	if err != nil {
+		return fmt.Errorf("can't write file '%s': %v", path, err)
+	}
+	return nil
+}
+
+// secretFields lists the Config fields whose values are kept in the SecretStore instead of the plain
+// text configuration file, together with the accessors used to move their values in and out.
+var secretFields = []struct {
+	key string
+	get func(cfg *Config) string
+	set func(cfg *Config, value string)
+}{
+	{"client_secret", func(cfg *Config) string { return cfg.ClientSecret }, func(cfg *Config, value string) { cfg.ClientSecret = value }},
+	{"password", func(cfg *Config) string { return cfg.Password }, func(cfg *Config, value string) { cfg.Password = value }},
+	{"access_token", func(cfg *Config) string { return cfg.AccessToken }, func(cfg *Config, value string) { cfg.AccessToken = value }},
+	{"refresh_token", func(cfg *Config) string { return cfg.RefreshToken }, func(cfg *Config, value string) { cfg.RefreshToken = value }},
+}
+
+// extractSecrets stores the sensitive fields of cfg in the given SecretStore under the given namespace
+// (typically the profile name) and returns a copy of cfg with those fields cleared, ready to be
+// written to the plain text configuration file.
+func extractSecrets(store SecretStore, namespace string, cfg *Config) (*Config, error) {
+	disk := new(Config)
+	*disk = *cfg
+	for _, field := range secretFields {
+		value := field.get(cfg)
+		field.set(disk, "")
+		if value == "" {
+			err := store.Delete(namespace, field.key)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err := store.Set(namespace, field.key, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return disk, nil
+}
+
+// injectSecrets fills in the sensitive fields of cfg by reading them from the given SecretStore under
+// the given namespace (typically the profile name).
+func injectSecrets(store SecretStore, namespace string, cfg *Config) error {
+	for _, field := range secretFields {
+		value, err := store.Get(namespace, field.key)
+		if err != nil {
+			if err == ErrSecretNotFound {
+				continue
+			}
+			return err
+		}
+		field.set(cfg, value)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+Copyright (c) 2018 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file contains TokenSource, which gives callers a ready to use, auto refreshing access token
+// instead of making every command re-implement its own "check armed, maybe re-login" logic.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultTokenThreshold is the amount of time before expiry at which a token is considered stale and
+// due for a refresh.
+const DefaultTokenThreshold = 5 * time.Minute
+
+// TokenSource is an oauth2.TokenSource backed by the configuration of a profile: it returns the
+// current access token while it has more than a threshold of life left, and otherwise refreshes it
+// using the refresh token, persisting the result back to the configuration. Concurrent calls are
+// collapsed into a single refresh with a singleflight.Group, and the persisted configuration is
+// protected with a file lock so that concurrent `uhc` invocations don't clobber each other.
+type TokenSource struct {
+	// Profile is the name of the profile whose configuration backs this token source.
+	Profile string
+
+	// Threshold is the minimum amount of time an access token must have left before expiry to be
+	// reused as is. Defaults to DefaultTokenThreshold.
+	Threshold time.Duration
+
+	mutex sync.Mutex
+	cfg   *Config
+	group singleflight.Group
+}
+
+// NewTokenSource creates a TokenSource for the given profile, initialized with the given
+// configuration.
+func NewTokenSource(profile string, cfg *Config) *TokenSource {
+	return &TokenSource{
+		Profile: profile,
+		cfg:     cfg,
+	}
+}
+
+// Token is part of the oauth2.TokenSource interface. It returns the current access token, refreshing
+// it first if it has less than Threshold left before expiry.
+func (s *TokenSource) Token() (*oauth2.Token, error) {
+	s.mutex.Lock()
+	cfg := s.cfg
+	s.mutex.Unlock()
+
+	if token, ok := usableToken(cfg, s.threshold()); ok {
+		return token, nil
+	}
+
+	value, err, _ := s.group.Do(s.Profile, func() (interface{}, error) {
+		return s.refresh()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*oauth2.Token), nil
+}
+
+// threshold returns the configured Threshold, or DefaultTokenThreshold if it hasn't been set.
+func (s *TokenSource) threshold() time.Duration {
+	if s.Threshold > 0 {
+		return s.Threshold
+	}
+	return DefaultTokenThreshold
+}
+
+// usableToken returns the access token from cfg as an oauth2.Token, and true, if it has more than
+// threshold left before expiry.
+func usableToken(cfg *Config, threshold time.Duration) (token *oauth2.Token, ok bool) {
+	if cfg == nil || cfg.AccessToken == "" {
+		return
+	}
+	expires, left, err := tokenExpiry(cfg.AccessToken, time.Now())
+	if err != nil || (expires && left <= threshold) {
+		return
+	}
+	token = &oauth2.Token{
+		AccessToken:  cfg.AccessToken,
+		RefreshToken: cfg.RefreshToken,
+		TokenType:    "Bearer",
+	}
+	ok = true
+	return
+}
+
+// refresh performs the actual token refresh. It is only ever run once at a time per profile, thanks to
+// the singleflight.Group in Token.
+func (s *TokenSource) refresh() (*oauth2.Token, error) {
+	path, err := Location()
+	if err != nil {
+		return nil, err
+	}
+	lock, err := newFileLock(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("can't acquire lock to refresh token: %v", err)
+	}
+	defer lock.Unlock()
+
+	// Another process may have already refreshed the token while we were waiting for the lock, so
+	// reload it from disk and check again before hitting the network.
+	cfg, err := LoadProfile(s.Profile)
+	if err != nil {
+		return nil, err
+	}
+	if token, ok := usableToken(cfg, s.threshold()); ok {
+		s.setConfig(cfg)
+		return token, nil
+	}
+	if cfg.RefreshToken == "" {
+		return nil, fmt.Errorf("can't refresh token: no refresh token available")
+	}
+
+	endpoint := oauth2.Endpoint{
+		TokenURL: cfg.TokenURL,
+	}
+	oauthCfg := &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		Endpoint:     endpoint,
+	}
+	source := oauthCfg.TokenSource(context.Background(), &oauth2.Token{
+		RefreshToken: cfg.RefreshToken,
+	})
+	token, err := source.Token()
+	if err != nil {
+		return nil, fmt.Errorf("can't refresh token: %v", err)
+	}
+
+	cfg.AccessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		cfg.RefreshToken = token.RefreshToken
+	}
+	err = SaveProfile(s.Profile, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("can't save refreshed token: %v", err)
+	}
+	s.setConfig(cfg)
+
+	return token, nil
+}
+
+// setConfig updates the configuration backing this token source.
+func (s *TokenSource) setConfig(cfg *Config) {
+	s.mutex.Lock()
+	s.cfg = cfg
+	s.mutex.Unlock()
+}